@@ -1,23 +1,63 @@
 package logger
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
-	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/RackSec/srslog"
+	"github.com/rs/zerolog"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 const LogLevelError = 0
 const LogLevelInfo = 1
 const LogLevelDebug = 2
 
+// defaultAsyncBufferSize is used when Async is enabled but AsyncBufferSize is unset.
+const defaultAsyncBufferSize = 1024
+
+func init() {
+	// Use "ts"/"msg" instead of zerolog's "time"/"message" defaults so the
+	// JSON output lines up with the field names the rest of our logging
+	// pipeline (and downstream log shippers) expect.
+	//
+	// zerolog.TimestampFieldName/MessageFieldName are package-level globals,
+	// not scoped to loggers created by this package, so importing this
+	// package renames those fields for every zerolog.Logger in the process,
+	// including ones a consumer creates directly. There's no per-instance
+	// alternative in zerolog's API; processes that also use zerolog on their
+	// own and rely on its default field names should be aware of this before
+	// depending on this package.
+	zerolog.TimestampFieldName = "ts"
+	zerolog.MessageFieldName = "msg"
+}
+
+type logRecordKind int
+
+const (
+	logKindDebug logRecordKind = iota
+	logKindInfo
+	logKindError
+)
+
+type logRecord struct {
+	kind logRecordKind
+	msg  string
+}
+
 type LoggerConfig struct {
 	LoggerName           string
 	Level                string
@@ -28,17 +68,294 @@ type LoggerConfig struct {
 	SyslogProtocol       string // "udp" or "tcp"
 	OutputFolder         string
 	RotationBySize       bool
-	MaxFileSizeMB        int // in bytes
-	MaxLogFiles          int // maximum number of log files to keep
-	RotationIntervalHour int // rotate log every N hours if LogRotationBySize is false
+	MaxFileSizeMB        int    // in megabytes
+	MaxLogFiles          int    // maximum number of log files to keep
+	RotationIntervalHour int    // rotate log every N hours if RotationBySize is false
+	CompressRotated      bool   // gzip rotated log files
+	MaxAgeDays           int    // delete rotated log files older than this many days (0 = keep forever)
+	LocalTime            bool   // use the local timezone when timestamping rotated files
+	Async                bool   // format and enqueue records instead of writing to sinks inline
+	AsyncBufferSize      int    // channel capacity when Async is true (defaults to defaultAsyncBufferSize)
+	Format               string // "text" (default) or "json"
+	ConsoleLevel         string // defaults to Level when empty
+	FileLevel            string // defaults to Level when empty
+	SyslogLevel          string // defaults to Level when empty
+}
+
+// logSinks holds the per-sink writers and their atomically-updatable levels,
+// shared (via pointer) by every *Logger handed out by the same factory so
+// that a level change applies process-wide regardless of which prefixed
+// Logger made it.
+type logSinks struct {
+	fileLogger    *log.Logger
+	fileLevel     *int32
+	consoleLogger *log.Logger
+	consoleLevel  *int32
+	syslogger     *srslog.Writer
+	syslogLevel   *int32
+}
+
+// write dispatches a formatted record to each sink whose current level
+// accepts it, reading the level with an atomic load so it can be changed
+// concurrently by SetLevel without locking the hot path.
+func (s *logSinks) write(kind logRecordKind, msg string) {
+	level := int32(kindToLevel(kind))
+	if s.syslogger != nil && atomic.LoadInt32(s.syslogLevel) >= level {
+		switch kind {
+		case logKindDebug:
+			s.syslogger.Debug(msg)
+		case logKindInfo:
+			s.syslogger.Info(msg)
+		case logKindError:
+			s.syslogger.Err(msg)
+		}
+	}
+	if s.fileLogger != nil && atomic.LoadInt32(s.fileLevel) >= level {
+		s.fileLogger.Print(msg)
+	}
+	if s.consoleLogger != nil && atomic.LoadInt32(s.consoleLevel) >= level {
+		s.consoleLogger.Print(msg)
+	}
+}
+
+// enabledForAny reports whether at least one enabled sink currently accepts
+// records at the given level, so callers can skip formatting work entirely.
+func (s *logSinks) enabledForAny(level int) bool {
+	lvl := int32(level)
+	if s.consoleLogger != nil && atomic.LoadInt32(s.consoleLevel) >= lvl {
+		return true
+	}
+	if s.fileLogger != nil && atomic.LoadInt32(s.fileLevel) >= lvl {
+		return true
+	}
+	if s.syslogger != nil && atomic.LoadInt32(s.syslogLevel) >= lvl {
+		return true
+	}
+	return false
+}
+
+func kindToLevel(kind logRecordKind) int {
+	switch kind {
+	case logKindDebug:
+		return LogLevelDebug
+	case logKindInfo:
+		return LogLevelInfo
+	default:
+		return LogLevelError
+	}
+}
+
+// isValidLevel reports whether level is one of the recognized log level
+// strings ("error", "info", "debug"), case-insensitively.
+func isValidLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "error", "info", "debug":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseLogLevel maps a config-style level string to one of the LogLevel*
+// constants, defaulting to LogLevelInfo for anything unrecognized. Callers
+// that need to reject bad input should check isValidLevel first.
+func parseLogLevel(level string) int {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LogLevelDebug
+	case "info":
+		return LogLevelInfo
+	case "error":
+		return LogLevelError
+	default:
+		return LogLevelInfo
+	}
 }
 
 type Logger struct {
-	logger    *log.Logger
-	prefix    string
-	syslogger *srslog.Writer
-	Destroy   func()
-	loglevel  int
+	sinks    *logSinks
+	prefix   string
+	Destroy  func()
+	loglevel int
+	async    bool
+	recordCh chan logRecord
+	// shutdownMu lets Destroy close recordCh only once every in-flight
+	// emit() call on it has returned, instead of closing a channel
+	// producers might still be sending on. emit holds a read lock for the
+	// duration of its send so concurrent emits don't block each other;
+	// Destroy takes the write lock after flagging stopping, which can only
+	// succeed once every emit holding a read lock has released it.
+	shutdownMu *sync.RWMutex
+	stopping   *int32
+	dropped    *int64
+	format   string
+	zl       *zerolog.Logger
+	fields   map[string]interface{}
+}
+
+// SetLevel changes the level of a single sink ("console", "file", or
+// "syslog") at runtime. It is safe to call concurrently with logging calls.
+// Returns an error if the sink is unknown or was never enabled.
+func (l *Logger) SetLevel(sink string, level string) error {
+	if !isValidLevel(level) {
+		return fmt.Errorf("invalid log level: %s (must be error, info, or debug)", level)
+	}
+	lvl := int32(parseLogLevel(level))
+	switch strings.ToLower(sink) {
+	case "console":
+		if l.sinks.consoleLogger == nil {
+			return fmt.Errorf("console sink is not enabled")
+		}
+		atomic.StoreInt32(l.sinks.consoleLevel, lvl)
+	case "file":
+		if l.sinks.fileLogger == nil {
+			return fmt.Errorf("file sink is not enabled")
+		}
+		atomic.StoreInt32(l.sinks.fileLevel, lvl)
+	case "syslog":
+		if l.sinks.syslogger == nil {
+			return fmt.Errorf("syslog sink is not enabled")
+		}
+		atomic.StoreInt32(l.sinks.syslogLevel, lvl)
+	default:
+		return fmt.Errorf("unknown log sink: %s (must be console, file, or syslog)", sink)
+	}
+	return nil
+}
+
+// LevelHandler returns an http.Handler that lets operators change a running
+// process's sink levels without a restart via
+// POST /loglevel?sink=file&level=debug.
+func LevelHandler(factory func(logname string) *Logger) http.Handler {
+	l := factory("")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := l.SetLevel(r.URL.Query().Get("sink"), r.URL.Query().Get("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// WatchSIGHUP spawns a goroutine that, on each SIGHUP, flips every enabled
+// sink between its level at call time and LogLevelDebug, so operators can
+// toggle verbosity on a running process with `kill -HUP`. Call the returned
+// function to stop watching.
+func (l *Logger) WatchSIGHUP() func() {
+	savedConsole := atomic.LoadInt32(l.sinks.consoleLevel)
+	savedFile := atomic.LoadInt32(l.sinks.fileLevel)
+	savedSyslog := atomic.LoadInt32(l.sinks.syslogLevel)
+	debugged := false
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-sigCh:
+				debugged = !debugged
+				if debugged {
+					atomic.StoreInt32(l.sinks.consoleLevel, int32(LogLevelDebug))
+					atomic.StoreInt32(l.sinks.fileLevel, int32(LogLevelDebug))
+					atomic.StoreInt32(l.sinks.syslogLevel, int32(LogLevelDebug))
+				} else {
+					atomic.StoreInt32(l.sinks.consoleLevel, savedConsole)
+					atomic.StoreInt32(l.sinks.fileLevel, savedFile)
+					atomic.StoreInt32(l.sinks.syslogLevel, savedSyslog)
+				}
+			case <-done:
+				signal.Stop(sigCh)
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// With returns a copy of the Logger with the given key/value attached as a
+// sticky field. Sticky fields are emitted on every subsequent record; in
+// "json" Format they appear as top-level JSON fields, and are ignored in
+// "text" Format.
+func (l *Logger) With(key string, val interface{}) *Logger {
+	newLogger := *l
+	newFields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		newFields[k] = v
+	}
+	newFields[key] = val
+	newLogger.fields = newFields
+	return &newLogger
+}
+
+// formatJSON renders a record through the Logger's zerolog instance into a
+// single JSON line, attaching the level, timestamp, caller, message, and any
+// fields added via With.
+func (l *Logger) formatJSON(kind logRecordKind, msg string) string {
+	var buf bytes.Buffer
+	zl := l.zl.Output(&buf)
+
+	var ev *zerolog.Event
+	switch kind {
+	case logKindDebug:
+		ev = zl.Debug()
+	case logKindInfo:
+		ev = zl.Info()
+	default:
+		ev = zl.Error()
+	}
+	if l.prefix != "" {
+		ev = ev.Str("logger", strings.TrimSuffix(l.prefix, ": "))
+	}
+	for k, v := range l.fields {
+		ev = ev.Interface(k, v)
+	}
+	ev.Msg(msg)
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+// Dropped returns the number of records discarded because the async buffer
+// was full. Always zero when Async is disabled.
+func (l *Logger) Dropped() int64 {
+	if l.dropped == nil {
+		return 0
+	}
+	return atomic.LoadInt64(l.dropped)
+}
+
+// emit routes a formatted record to the sinks, either inline or, when running
+// in async mode, onto the buffered channel drained by the background
+// goroutine started in initLoggerFactory.
+func (l *Logger) emit(kind logRecordKind, msg string) {
+	if l.async {
+		l.shutdownMu.RLock()
+		defer l.shutdownMu.RUnlock()
+		// Destroy takes the write lock only after setting stopping, so by the
+		// time it acquires it every emit that got here first has already
+		// finished its send; any emit after that point sees stopping and
+		// bails out instead of sending on a channel Destroy is about to close.
+		if atomic.LoadInt32(l.stopping) != 0 {
+			if l.dropped != nil {
+				atomic.AddInt64(l.dropped, 1)
+			}
+			return
+		}
+		select {
+		case l.recordCh <- logRecord{kind: kind, msg: msg}:
+		default:
+			if l.dropped != nil {
+				atomic.AddInt64(l.dropped, 1)
+			}
+		}
+		return
+	}
+	l.sinks.write(kind, msg)
 }
 
 // --------------------
@@ -66,43 +383,43 @@ func getCallerFuncName() string {
 }
 
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.loglevel >= LogLevelDebug {
-		caller := getCallerFuncName() + ": "
-		if l.syslogger != nil {
-			l.syslogger.Debug(fmt.Sprintf(l.prefix+caller+"debug: "+format, v...))
-		}
-		if l.logger != nil {
-			l.logger.Printf(l.prefix+caller+"debug: "+format, v...)
+	if l.sinks.enabledForAny(LogLevelDebug) {
+		if l.format == "json" {
+			l.emit(logKindDebug, l.formatJSON(logKindDebug, fmt.Sprintf(format, v...)))
+			return
 		}
+		caller := getCallerFuncName() + ": "
+		l.emit(logKindDebug, fmt.Sprintf(l.prefix+caller+"debug: "+format, v...))
 	}
 }
 
 func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.loglevel >= LogLevelInfo {
+	if l.sinks.enabledForAny(LogLevelInfo) {
+		if l.format == "json" {
+			l.emit(logKindInfo, l.formatJSON(logKindInfo, fmt.Sprintf(format, v...)))
+			return
+		}
 		caller := ""
 		if l.loglevel >= LogLevelDebug {
 			caller = getCallerFuncName() + ": "
 		}
-		if l.syslogger != nil {
-			l.syslogger.Info(fmt.Sprintf(l.prefix+caller+"info: "+format, v...))
-		}
-		if l.logger != nil {
-			l.logger.Printf(l.prefix+caller+"info: "+format, v...)
-		}
+		l.emit(logKindInfo, fmt.Sprintf(l.prefix+caller+"info: "+format, v...))
 	}
 }
 
 func (l *Logger) Errorf(format string, v ...interface{}) {
+	if !l.sinks.enabledForAny(LogLevelError) {
+		return
+	}
+	if l.format == "json" {
+		l.emit(logKindError, l.formatJSON(logKindError, fmt.Sprintf(format, v...)))
+		return
+	}
 	caller := ""
 	if l.loglevel >= LogLevelDebug {
 		caller = getCallerFuncName() + ": "
 	}
-	if l.syslogger != nil {
-		l.syslogger.Err(fmt.Sprintf(l.prefix+caller+"error: "+format, v...))
-	}
-	if l.logger != nil {
-		l.logger.Printf(l.prefix+caller+"error: "+format, v...)
-	}
+	l.emit(logKindError, fmt.Sprintf(l.prefix+caller+"error: "+format, v...))
 }
 
 // ---------------------
@@ -115,8 +432,7 @@ func Validate(c LoggerConfig) error {
 	}
 
 	// Validate log level
-	logLevel := strings.ToLower(c.Level)
-	if logLevel != "error" && logLevel != "info" && logLevel != "debug" {
+	if !isValidLevel(c.Level) {
 		return fmt.Errorf("invalid log level: %s (must be error, info, or debug)", c.Level)
 	}
 
@@ -149,6 +465,23 @@ func Validate(c LoggerConfig) error {
 		return fmt.Errorf("maximum number of log files must be greater than 0")
 	}
 
+	// Validate output format
+	logFormat := strings.ToLower(c.Format)
+	if logFormat != "" && logFormat != "text" && logFormat != "json" {
+		return fmt.Errorf("invalid log format: %s (must be text or json)", c.Format)
+	}
+
+	// Validate per-sink level overrides, if set
+	for sinkName, sinkLevel := range map[string]string{
+		"console": c.ConsoleLevel,
+		"file":    c.FileLevel,
+		"syslog":  c.SyslogLevel,
+	} {
+		if sinkLevel != "" && !isValidLevel(sinkLevel) {
+			return fmt.Errorf("invalid %s log level: %s (must be error, info, or debug)", sinkName, sinkLevel)
+		}
+	}
+
 	return nil
 }
 
@@ -165,11 +498,20 @@ func InitLoggerFactoryByObj(loggerCfg LoggerConfig) func(logname string) *Logger
 		loggerCfg.MaxFileSizeMB,
 		loggerCfg.MaxLogFiles,
 		loggerCfg.RotationIntervalHour,
+		loggerCfg.MaxAgeDays,
+		loggerCfg.CompressRotated,
+		loggerCfg.LocalTime,
 		loggerCfg.EnableConsoleLog,
 		loggerCfg.EnableSyslog,
 		loggerCfg.SyslogHost,
 		loggerCfg.SyslogPort,
-		loggerCfg.SyslogProtocol)
+		loggerCfg.SyslogProtocol,
+		loggerCfg.Async,
+		loggerCfg.AsyncBufferSize,
+		loggerCfg.Format,
+		loggerCfg.ConsoleLevel,
+		loggerCfg.FileLevel,
+		loggerCfg.SyslogLevel)
 }
 
 func initLoggerFactory(
@@ -180,24 +522,46 @@ func initLoggerFactory(
 	logMaxFileSize int,
 	logMaxFiles int,
 	logRotationIntervalHour int,
+	logMaxAgeDays int,
+	logCompressRotated bool,
+	logLocalTime bool,
 	enableConsoleLog bool,
 	enableSyslog bool,
 	syslogHost string,
 	syslogPort int,
-	syslogProtocol string) func(logname string) *Logger {
+	syslogProtocol string,
+	async bool,
+	asyncBufferSize int,
+	logFormat string,
+	consoleLevel string,
+	fileLevel string,
+	syslogLevel string) func(logname string) *Logger {
+
+	logFormat = strings.ToLower(logFormat)
+	if logFormat == "" {
+		logFormat = "text"
+	}
+	if consoleLevel == "" {
+		consoleLevel = logLevel
+	}
+	if fileLevel == "" {
+		fileLevel = logLevel
+	}
+	if syslogLevel == "" {
+		syslogLevel = logLevel
+	}
 
 	var myLogger Logger
-	loglevellc := strings.ToLower(logLevel)
-	switch loglevellc {
-	case "debug":
-		myLogger.loglevel = LogLevelDebug
-	case "info":
-		myLogger.loglevel = LogLevelInfo
-	case "error":
-		myLogger.loglevel = LogLevelError
-	default:
-		myLogger.loglevel = LogLevelInfo
+	myLogger.format = logFormat
+	myLogger.loglevel = parseLogLevel(logLevel)
+	myLogger.sinks = &logSinks{
+		consoleLevel: new(int32),
+		fileLevel:    new(int32),
+		syslogLevel:  new(int32),
 	}
+	atomic.StoreInt32(myLogger.sinks.consoleLevel, int32(parseLogLevel(consoleLevel)))
+	atomic.StoreInt32(myLogger.sinks.fileLevel, int32(parseLogLevel(fileLevel)))
+	atomic.StoreInt32(myLogger.sinks.syslogLevel, int32(parseLogLevel(syslogLevel)))
 
 	// Initialize the logger
 	var locallogger_destroy func()
@@ -205,19 +569,68 @@ func initLoggerFactory(
 
 	// Rotate every hour if logRotationBySize is false
 	logRotationInterval := time.Duration(logRotationIntervalHour) * time.Hour
-	myLogger.logger, locallogger_destroy = createCustomFileLogger(
+	myLogger.sinks.fileLogger, locallogger_destroy = createFileLogger(
 		loggerName, logOutputFolder, logRotationBySize, logMaxFileSize,
-		logMaxFiles, logRotationInterval, enableConsoleLog)
+		logMaxFiles, logMaxAgeDays, logRotationInterval,
+		logCompressRotated, logLocalTime, logFormat)
+
+	if enableConsoleLog {
+		if logFormat == "json" {
+			myLogger.sinks.consoleLogger = log.New(os.Stdout, "", 0)
+		} else {
+			myLogger.sinks.consoleLogger = log.New(os.Stdout, loggerName+": ", log.LstdFlags)
+		}
+	}
+
+	if logFormat == "json" {
+		zl := zerolog.New(io.Discard).With().
+			Timestamp().
+			CallerWithSkipFrameCount(zerolog.CallerSkipFrameCount + 2).
+			Logger()
+		myLogger.zl = &zl
+	}
 
 	if enableSyslog {
-		myLogger.syslogger, syslogger_destroy = createSysLogger(
+		myLogger.sinks.syslogger, syslogger_destroy = createSysLogger(
 			loggerName,
 			syslogHost,
 			syslogPort,
 			syslogProtocol)
 	}
 
+	var drainDone chan struct{}
+	if async {
+		bufSize := asyncBufferSize
+		if bufSize <= 0 {
+			bufSize = defaultAsyncBufferSize
+		}
+		myLogger.async = true
+		myLogger.recordCh = make(chan logRecord, bufSize)
+		myLogger.dropped = new(int64)
+		myLogger.stopping = new(int32)
+		myLogger.shutdownMu = &sync.RWMutex{}
+
+		drainDone = make(chan struct{})
+		sinks, recordCh := myLogger.sinks, myLogger.recordCh
+		go func() {
+			defer close(drainDone)
+			for rec := range recordCh {
+				sinks.write(rec.kind, rec.msg)
+			}
+		}()
+	}
+
 	myLogger.Destroy = func() {
+		if myLogger.recordCh != nil {
+			// Flag stopping, then take the write lock: this can only succeed
+			// once every emit holding the read lock has released it, so no
+			// send can still be in flight once we close the channel.
+			atomic.StoreInt32(myLogger.stopping, 1)
+			myLogger.shutdownMu.Lock()
+			close(myLogger.recordCh)
+			myLogger.shutdownMu.Unlock()
+			<-drainDone
+		}
 		if locallogger_destroy != nil {
 			locallogger_destroy()
 		}
@@ -259,136 +672,164 @@ func createSysLogger(loggerName string, host string, port int, protocol string)
 	return syslogWriter, destroyFunc
 }
 
-// createCustomFileLogger initializes a custom file logger with rotation support
-func createCustomFileLogger(
+// lumberjackBackupPattern matches the backup filenames lumberjack.Logger
+// produces on rotation: "<prefix>-2006-01-02T15-04-05.000.log[.gz]".
+var lumberjackBackupPattern = regexp.MustCompile(`^(.+)-(\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}\.\d{3})(\.log)(\.gz)?$`)
+
+// renameBackups finds lumberjack backup files for loggerName in dir and
+// renames them from lumberjack's own backup format to the
+// "loggerName-YYYYMMDD-HH.log[.gz]" suffix this package documents, since
+// lumberjack.Logger doesn't expose a hook to override its backup naming
+// directly. If two rotations land in the same hour, later ones get a
+// "-N" suffix instead of overwriting the earlier file.
+func renameBackups(dir, loggerName string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		matches := lumberjackBackupPattern.FindStringSubmatch(name)
+		if matches == nil || matches[1] != loggerName {
+			continue
+		}
+		ts, err := time.Parse("2006-01-02T15-04-05.000", matches[2])
+		if err != nil {
+			continue
+		}
+		ext := ".log"
+		if matches[4] != "" {
+			ext = ".log.gz"
+		}
+		newName := uniqueBackupName(dir, fmt.Sprintf("%s-%s%s", loggerName, ts.Format("20060102-15"), ext))
+		if newName == name {
+			continue
+		}
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(dir, newName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uniqueBackupName returns name, or name with a "-N" suffix inserted before
+// its extension if name is already taken in dir.
+func uniqueBackupName(dir, name string) string {
+	ext := ".log"
+	if strings.HasSuffix(name, ".log.gz") {
+		ext = ".log.gz"
+	}
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for n := 1; ; n++ {
+		if _, err := os.Stat(filepath.Join(dir, candidate)); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+}
+
+// renamingRotator wraps a *lumberjack.Logger and renames any backup file it
+// produced immediately after each Write, since size-based rotation happens
+// synchronously inside lumberjack's own Write and gives us no other hook to
+// act on it.
+type renamingRotator struct {
+	*lumberjack.Logger
+	loggerName string
+	logDir     string
+}
+
+func (r *renamingRotator) Write(p []byte) (int, error) {
+	n, err := r.Logger.Write(p)
+	if renameErr := renameBackups(r.logDir, r.loggerName); renameErr != nil {
+		fmt.Printf("log rotation: failed to rename rotated log file: %v\n", renameErr)
+	}
+	return n, err
+}
+
+// createFileLogger initializes a file logger backed by lumberjack, which owns
+// rotation, compression, and retention so size-based and time-based rotation
+// share a single code path instead of duplicating it. Rotated files are
+// renamed from lumberjack's own backup format to "loggername-YYYYMMDD-HH.log"
+// (gzipped when CompressRotated is true) via renameBackups, run after every
+// write that might have triggered a rotation.
+func createFileLogger(
 	loggerName,
 	logDir string,
 	rotateBySize bool,
-	maxSize int,
+	maxSizeMB int,
 	maxLogFiles int,
+	maxAgeDays int,
 	rotationInterval time.Duration,
-	EnableConsoleLog bool) (*log.Logger, func()) {
+	compressRotated bool,
+	localTime bool,
+	format string) (*log.Logger, func()) {
 
 	// Ensure the log directory exists
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		log.Fatalf("failed to create log directory: %v", err)
 	}
 
-	// Open the log file
 	fileName := filepath.Join(logDir, loggerName+".log")
-	logFile, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("failed to open log file: %v", err)
-	}
-
-	// Combine log file and console output
-	var multiWriter io.Writer
-	if EnableConsoleLog {
-		multiWriter = io.MultiWriter(logFile, os.Stdout)
-	} else {
-		multiWriter = io.MultiWriter(logFile)
-	}
-
-	// Start a goroutine for log rotation
-	var quitRotation = false
-	go func() {
-
-		cleanupLogFiles(logDir, maxLogFiles)
-		// get the current hour
-		lastHour := time.Now().Hour()
-		for {
-			if quitRotation {
-				return
-			}
-			if rotateBySize {
-				// Rotate by size
-				fileInfo, err := logFile.Stat()
-				if err == nil && fileInfo.Size() >= int64(maxSize) {
-					rotateLogFile(logFile, fileName)
-					cleanupLogFiles(logDir, maxLogFiles) // Clean up old log files
-				}
-				time.Sleep(10 * time.Second) // Check periodically
-			} else {
-				// Rotate by time
-				currentHour := time.Now().Hour()
-				if currentHour != lastHour {
-					if (currentHour % int(rotationInterval.Hours())) == 0 {
-						fmt.Println("rotating log file by time")
-						rotateLogFile(logFile, fileName)
-						cleanupLogFiles(logDir, maxLogFiles) // Clean up old log files
+	rotator := &lumberjack.Logger{
+		Filename:   fileName,
+		MaxSize:    maxSizeMB,
+		MaxBackups: maxLogFiles,
+		MaxAge:     maxAgeDays,
+		Compress:   compressRotated,
+		LocalTime:  localTime,
+	}
+	renamingWriter := &renamingRotator{Logger: rotator, loggerName: loggerName, logDir: logDir}
+
+	// Size-based rotation is handled by lumberjack on every Write; time-based
+	// rotation is driven here by forcing a Rotate() on a ticker so both paths
+	// end up going through lumberjack's retention policy.
+	var ticker *time.Ticker
+	quit := make(chan struct{})
+	tickerDone := make(chan struct{})
+	if !rotateBySize {
+		ticker = time.NewTicker(rotationInterval)
+		go func() {
+			defer close(tickerDone)
+			for {
+				select {
+				case <-ticker.C:
+					if err := rotator.Rotate(); err != nil {
+						fmt.Printf("log rotation: failed to rotate log file: %v\n", err)
+					} else if err := renameBackups(logDir, loggerName); err != nil {
+						fmt.Printf("log rotation: failed to rename rotated log file: %v\n", err)
 					}
-					lastHour = currentHour
+				case <-quit:
+					return
 				}
-				time.Sleep(1 * time.Second) // Check periodically
 			}
-		}
-	}()
+		}()
+	}
 
+	// Wait for the rotation goroutine to actually exit before closing the
+	// file, so Destroy can't race a rotation with the shutdown.
 	destroyFunc := func() {
-		quitRotation = true
-		if logFile != nil {
-			logFile.Close()
+		if ticker != nil {
+			ticker.Stop()
+			close(quit)
+			<-tickerDone
 		}
+		rotator.Close()
+	}
+	// In JSON mode the records arriving here are already complete, timestamped
+	// lines produced by zerolog, so the logger must not prepend its own
+	// prefix or timestamp.
+	if format == "json" {
+		return log.New(renamingWriter, "", 0), destroyFunc
 	}
+
 	// Create and return the logger
-	logger := log.New(multiWriter, loggerName+": ", log.LstdFlags|log.Lshortfile)
+	logger := log.New(renamingWriter, loggerName+": ", log.LstdFlags|log.Lshortfile)
 	currentFlags := logger.Flags()                               // Get the current flags
 	newFlags := currentFlags &^ (log.Lshortfile | log.Llongfile) // Remove the Lshortfile and Llongfile flags
 	logger.SetFlags(newFlags)                                    // Set the modified flags
 	return logger, destroyFunc
 }
-
-func cleanupLogFiles(logOutputFolder string, maxLogFiles int) {
-	files, err := os.ReadDir(logOutputFolder)
-	if err != nil {
-		fmt.Printf("failed to read log output folder: %v\n", err)
-		return
-	}
-
-	var logFiles []string
-	for _, file := range files {
-		if file.Name() != "kodo.log" && !file.IsDir() {
-			logFiles = append(logFiles, file.Name())
-		}
-	}
-
-	// Sort log files by filename
-	sort.Strings(logFiles)
-
-	// Keep only the newest maxLogFiles copies
-	if len(logFiles) > maxLogFiles {
-		filesToDelete := logFiles[:len(logFiles)-maxLogFiles]
-		for _, file := range filesToDelete {
-			filePath := filepath.Join(logOutputFolder, file)
-			if err := os.Remove(filePath); err != nil {
-				fmt.Printf("failed to delete old log file %s: %v", filePath, err)
-			}
-		}
-	}
-}
-
-// rotateLogFile handles log file rotation
-func rotateLogFile(logFile *os.File, fileName string) {
-	// Close the current log file
-	err := logFile.Close()
-	if err != nil {
-		fmt.Printf("log rotation: failed to closed current log file: %v\n", err)
-		return
-	}
-
-	// Rename the current log file with a timestamp
-	timestamp := time.Now().Format("20060102-15")
-	rotatedFileName := fmt.Sprintf("%s.%s", fileName, timestamp)
-	if err := os.Rename(fileName, rotatedFileName); err != nil {
-		fmt.Printf("log rotation: failed to rotate log file: %v", err)
-	}
-
-	// Open a new log file
-	newLogFile, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Printf("log rotation: failed to open new log file: %v", err)
-	}
-
-	// Update the log file reference
-	*logFile = *newLogFile
-}
@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestAsyncDestroyDoesNotRace exercises concurrent Infof calls racing against
+// Destroy, which used to close recordCh while a producer was still mid-send
+// on it (a "send on closed channel" panic), and which an earlier WaitGroup-
+// based fix then turned into a "sync: WaitGroup is reused before previous
+// Wait has returned" panic whenever a producer burst drained to zero before
+// Destroy ran and a fresh Infof raced in while Destroy was blocked in Wait.
+// To catch that, Destroy is fired with no delay (not after producers are
+// likely done) against a buffer small enough to force contention, repeated
+// many times so the adversarial interleaving is hit reliably. Run with
+// -race to also catch the underlying data race, not just the panic.
+func TestAsyncDestroyDoesNotRace(t *testing.T) {
+	for iter := 0; iter < 200; iter++ {
+		factory := InitLoggerFactoryByObj(LoggerConfig{
+			LoggerName:      "asyncrace",
+			Level:           "debug",
+			OutputFolder:    t.TempDir(),
+			RotationBySize:  true,
+			MaxFileSizeMB:   1,
+			MaxLogFiles:     1,
+			Async:           true,
+			AsyncBufferSize: 1,
+		})
+		l := factory("")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					l.Infof("producer %d message %d", n, j)
+				}
+			}(i)
+		}
+
+		go l.Destroy()
+		wg.Wait()
+	}
+}
+
+// TestJSONFieldNames verifies that "json" Format output uses the ts/msg
+// field names this pipeline expects rather than zerolog's time/message
+// defaults.
+func TestJSONFieldNames(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	origStdout := os.Stdout
+	os.Stdout = w
+
+	factory := InitLoggerFactoryByObj(LoggerConfig{
+		LoggerName:       "jsonfields",
+		Level:            "debug",
+		OutputFolder:     t.TempDir(),
+		RotationBySize:   true,
+		MaxFileSizeMB:    1,
+		MaxLogFiles:      1,
+		EnableConsoleLog: true,
+		Format:           "json",
+	})
+	l := factory("")
+	l.Infof("hello %s", "world")
+
+	os.Stdout = origStdout
+	w.Close()
+
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		t.Fatalf("failed to read log line: %v", err)
+	}
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &rec); err != nil {
+		t.Fatalf("log line is not valid JSON: %v\nline: %s", err, line)
+	}
+
+	if rec["level"] != "info" {
+		t.Errorf("level = %v, want %q", rec["level"], "info")
+	}
+	if rec["msg"] != "hello world" {
+		t.Errorf("msg = %v, want %q", rec["msg"], "hello world")
+	}
+	if _, ok := rec["ts"]; !ok {
+		t.Errorf("expected a \"ts\" field, got %v", rec)
+	}
+	if _, ok := rec["time"]; ok {
+		t.Errorf("unexpected zerolog default \"time\" field present: %v", rec)
+	}
+}